@@ -0,0 +1,410 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"fmt"
+	"regexp"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	rbacconfig "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2alpha"
+	"github.com/google/cel-go/cel"
+	"github.com/google/cel-go/checker/decls"
+	exprpb "google.golang.org/genproto/googleapis/api/expr/v1alpha1"
+)
+
+// celAttributes are the Istio attributes exposed to a condition written in CEL, matching
+// the vocabulary documented for key/value conditions elsewhere in this package.
+var celAttributes = []*exprpb.Decl{
+	decls.NewVar("request.headers", decls.NewMapType(decls.String, decls.String)),
+	decls.NewVar("request.path", decls.String),
+	decls.NewVar("request.method", decls.String),
+	decls.NewVar("request.time", decls.Timestamp),
+	decls.NewVar("source.ip", decls.String),
+	decls.NewVar("source.principal", decls.String),
+	decls.NewVar("destination.ip", decls.String),
+	decls.NewVar("destination.port", decls.Int),
+	decls.NewVar("connection.sni", decls.String),
+}
+
+// celFunctions declares the non-standard functions a condition may call, e.g.
+// source.ip.inCidr("10.0.0.0/8").
+var celFunctions = []*exprpb.Decl{
+	decls.NewFunction("inCidr",
+		decls.NewInstanceOverload("string_in_cidr", []*exprpb.Type{decls.String, decls.String}, decls.Bool)),
+}
+
+// newCELEnv returns the CEL environment conditions are compiled against. It builds a new
+// env on every call; compileCELExpr calls it once per compile.
+func newCELEnv() (*cel.Env, error) {
+	return cel.NewEnv(cel.Declarations(append(celAttributes, celFunctions...)...))
+}
+
+// compileCELExpr parses and type-checks expr against newCELEnv and returns its checked
+// AST root, shared by every entry point below so they can't drift out of sync with each
+// other on what counts as a valid condition.
+func compileCELExpr(expr string) (*exprpb.Expr, error) {
+	env, err := newCELEnv()
+	if err != nil {
+		return nil, fmt.Errorf("failed to build CEL environment: %v", err)
+	}
+	ast, issues := env.Compile(expr)
+	if issues != nil && issues.Err() != nil {
+		return nil, fmt.Errorf("invalid CEL condition %q: %v", expr, issues.Err())
+	}
+	checked, err := cel.AstToCheckedExpr(ast)
+	if err != nil {
+		return nil, fmt.Errorf("failed to check CEL condition %q: %v", expr, err)
+	}
+	return checked.GetExpr(), nil
+}
+
+// ValidateCELCondition reports an error if expr is not a well-formed, well-typed condition
+// over the Istio attribute vocabulary, or if it cannot be lowered to a native Envoy RBAC
+// policy by compileCELCondition. It is exported so that config validation can reject such a
+// condition at admission time instead of at xDS push time; within this repository it is
+// called only by this package's tests.
+func ValidateCELCondition(expr string) error {
+	rootExpr, err := compileCELExpr(expr)
+	if err != nil {
+		return err
+	}
+	if _, ok := lowerCELBoolean(rootExpr); !ok {
+		return fmt.Errorf("CEL condition %q cannot be lowered to a native Envoy RBAC policy; "+
+			"rewrite it in terms of header, path, method, destination port or source IP "+
+			"predicates combined with && / || / !", expr)
+	}
+	return nil
+}
+
+// convertToCELCondition compiles a CEL expression that reduces to a single header
+// predicate, e.g. `request.headers['x-user'].startsWith('admin-')`, into the equivalent
+// HeaderMatcher. It is the CEL sibling of convertToHeaderMatcher: conditions that combine
+// more than one predicate should go through compileCELCondition instead, which builds the
+// full RBAC policy tree.
+func convertToCELCondition(expr string) (*route.HeaderMatcher, error) {
+	rootExpr, err := compileCELExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+	matcher, ok := headerMatcherFromExpr(rootExpr)
+	if !ok {
+		return nil, fmt.Errorf("CEL condition %q does not reduce to a single header match", expr)
+	}
+	return matcher, nil
+}
+
+// headerMatcherFromExpr recognizes the small set of CEL call shapes that translate
+// directly to a HeaderMatcher: request.headers['k'] == 'v', .startsWith(v), .endsWith(v)
+// and .contains(v).
+func headerMatcherFromExpr(expr *exprpb.Expr) (*route.HeaderMatcher, bool) {
+	call := expr.GetCallExpr()
+	if call == nil || len(call.GetArgs()) == 0 {
+		return nil, false
+	}
+
+	if call.GetFunction() == "_==_" && call.GetTarget() == nil && len(call.GetArgs()) == 2 {
+		header, ok := headerKeyFromExpr(call.GetArgs()[0])
+		if !ok {
+			return nil, false
+		}
+		value, ok := stringConst(call.GetArgs()[1])
+		if !ok {
+			return nil, false
+		}
+		return &route.HeaderMatcher{Name: header, HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: value}}, true
+	}
+
+	header, ok := headerKeyFromExpr(call.GetTarget())
+	if !ok || len(call.GetArgs()) != 1 {
+		return nil, false
+	}
+	value, ok := stringConst(call.GetArgs()[0])
+	if !ok {
+		return nil, false
+	}
+
+	matcher := &route.HeaderMatcher{Name: header}
+	switch call.GetFunction() {
+	case "startsWith":
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_PrefixMatch{PrefixMatch: value}
+	case "endsWith":
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_SuffixMatch{SuffixMatch: value}
+	case "contains":
+		matcher.HeaderMatchSpecifier = &route.HeaderMatcher_RegexMatch{RegexMatch: "^.*" + regexp.QuoteMeta(value) + ".*$"}
+	default:
+		return nil, false
+	}
+	return matcher, true
+}
+
+// headerKeyFromExpr recognizes the `request.headers['k']` index expression and returns "k".
+func headerKeyFromExpr(expr *exprpb.Expr) (string, bool) {
+	call := expr.GetCallExpr()
+	if call == nil || call.GetFunction() != "_[_]" || len(call.GetArgs()) != 2 {
+		return "", false
+	}
+	sel := call.GetArgs()[0].GetSelectExpr()
+	if sel == nil || sel.GetField() != "headers" || sel.GetOperand().GetIdentExpr().GetName() != "request" {
+		return "", false
+	}
+	return stringConst(call.GetArgs()[1])
+}
+
+// pathOrMethodMatcherFromExpr recognizes `request.path == 'v'` and `request.method == 'v'`,
+// translating them into a HeaderMatcher on the corresponding Envoy pseudo-header.
+func pathOrMethodMatcherFromExpr(expr *exprpb.Expr) (*route.HeaderMatcher, bool) {
+	call := expr.GetCallExpr()
+	if call == nil || call.GetFunction() != "_==_" || len(call.GetArgs()) != 2 {
+		return nil, false
+	}
+	sel := call.GetArgs()[0].GetSelectExpr()
+	if sel == nil || sel.GetOperand().GetIdentExpr().GetName() != "request" {
+		return nil, false
+	}
+	value, ok := stringConst(call.GetArgs()[1])
+	if !ok {
+		return nil, false
+	}
+	var name string
+	switch sel.GetField() {
+	case "path":
+		name = ":path"
+	case "method":
+		name = ":method"
+	default:
+		return nil, false
+	}
+	return &route.HeaderMatcher{Name: name, HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{ExactMatch: value}}, true
+}
+
+// destinationPortFromExpr recognizes `destination.port == N` and returns N.
+func destinationPortFromExpr(expr *exprpb.Expr) (uint32, bool) {
+	call := expr.GetCallExpr()
+	if call == nil || call.GetFunction() != "_==_" || len(call.GetArgs()) != 2 {
+		return 0, false
+	}
+	sel := call.GetArgs()[0].GetSelectExpr()
+	if sel == nil || sel.GetField() != "port" || sel.GetOperand().GetIdentExpr().GetName() != "destination" {
+		return 0, false
+	}
+	c := call.GetArgs()[1].GetConstExpr()
+	if c == nil || c.GetInt64Value() < 0 {
+		return 0, false
+	}
+	return uint32(c.GetInt64Value()), true
+}
+
+// sourceIPCidrFromExpr recognizes `source.ip.inCidr('cidr')` and returns the parsed CIDR.
+func sourceIPCidrFromExpr(expr *exprpb.Expr) (*core.CidrRange, bool) {
+	call := expr.GetCallExpr()
+	if call == nil || call.GetFunction() != "inCidr" || len(call.GetArgs()) != 1 {
+		return nil, false
+	}
+	sel := call.GetTarget().GetSelectExpr()
+	if sel == nil || sel.GetField() != "ip" || sel.GetOperand().GetIdentExpr().GetName() != "source" {
+		return nil, false
+	}
+	value, ok := stringConst(call.GetArgs()[0])
+	if !ok {
+		return nil, false
+	}
+	cidr, err := convertToCidr(value)
+	if err != nil {
+		return nil, false
+	}
+	return cidr, true
+}
+
+// stringConst returns the string value of expr if it is a string constant, distinguishing
+// the empty string "" (ok=true) from "not a string constant at all" (ok=false) by switching
+// on the ConstantKind oneof instead of comparing the unwrapped value to "".
+func stringConst(expr *exprpb.Expr) (string, bool) {
+	c := expr.GetConstExpr()
+	if c == nil {
+		return "", false
+	}
+	sv, ok := c.GetConstantKind().(*exprpb.Constant_StringValue)
+	if !ok {
+		return "", false
+	}
+	return sv.StringValue, true
+}
+
+// celParts accumulates the permission-side (what the request looks like) and
+// principal-side (who is making it) pieces a CEL condition lowers to. A leaf sets exactly
+// one of the two slices to a single element; lowerCELBoolean combines leaves from there.
+type celParts struct {
+	Permissions []*rbacconfig.Permission
+	Principals  []*rbacconfig.Principal
+}
+
+// lowerCELBoolean recursively lowers the boolean structure of a checked CEL expression
+// into native Envoy RBAC permission/principal pieces, short-circuiting `&&`/`||`/`!`.
+// It returns ok=false the moment it hits a shape it cannot lower natively (a `||` or `!`
+// mixing permission- and principal-side leaves, or an attribute/operator this package
+// doesn't recognize), so the caller can refuse the condition outright rather than silently
+// enforcing less than what was written.
+func lowerCELBoolean(expr *exprpb.Expr) (*celParts, bool) {
+	call := expr.GetCallExpr()
+	if call == nil {
+		return lowerCELLeaf(expr)
+	}
+
+	switch call.GetFunction() {
+	case "_&&_":
+		var parts celParts
+		for _, arg := range call.GetArgs() {
+			sub, ok := lowerCELBoolean(arg)
+			if !ok {
+				return nil, false
+			}
+			parts.Permissions = append(parts.Permissions, sub.Permissions...)
+			parts.Principals = append(parts.Principals, sub.Principals...)
+		}
+		return &parts, true
+	case "_||_":
+		return lowerCELDisjunction(call.GetArgs())
+	case "!_":
+		sub, ok := lowerCELBoolean(call.GetArgs()[0])
+		if !ok {
+			return nil, false
+		}
+		switch {
+		case len(sub.Permissions) == 1 && len(sub.Principals) == 0:
+			return &celParts{Permissions: []*rbacconfig.Permission{
+				{Rule: &rbacconfig.Permission_NotRule{NotRule: sub.Permissions[0]}},
+			}}, true
+		case len(sub.Principals) == 1 && len(sub.Permissions) == 0:
+			return &celParts{Principals: []*rbacconfig.Principal{
+				{Identifier: &rbacconfig.Principal_NotId{NotId: sub.Principals[0]}},
+			}}, true
+		default:
+			return nil, false
+		}
+	default:
+		return lowerCELLeaf(expr)
+	}
+}
+
+// lowerCELDisjunction lowers `_||_`. Envoy's RBAC Policy can only OR permissions together
+// or principals together, not a mix of the two in the same alternation (that would require
+// a different principal set per permission branch, which Policy can't express), so a `||`
+// that mixes categories is rejected rather than approximated.
+func lowerCELDisjunction(args []*exprpb.Expr) (*celParts, bool) {
+	var permOrs []*rbacconfig.Permission
+	var prinOrs []*rbacconfig.Principal
+	for _, arg := range args {
+		sub, ok := lowerCELBoolean(arg)
+		if !ok {
+			return nil, false
+		}
+		switch {
+		case len(sub.Permissions) == 1 && len(sub.Principals) == 0:
+			permOrs = append(permOrs, sub.Permissions[0])
+		case len(sub.Principals) == 1 && len(sub.Permissions) == 0:
+			prinOrs = append(prinOrs, sub.Principals[0])
+		default:
+			return nil, false
+		}
+	}
+	switch {
+	case len(permOrs) == len(args):
+		return &celParts{Permissions: []*rbacconfig.Permission{
+			{Rule: &rbacconfig.Permission_OrRules{OrRules: &rbacconfig.Permission_Set{Rules: permOrs}}},
+		}}, true
+	case len(prinOrs) == len(args):
+		return &celParts{Principals: []*rbacconfig.Principal{
+			{Identifier: &rbacconfig.Principal_OrIds{OrIds: &rbacconfig.Principal_Set{Ids: prinOrs}}},
+		}}, true
+	default:
+		return nil, false
+	}
+}
+
+// lowerCELLeaf lowers a single (non-boolean-combinator) predicate to either a permission
+// or a principal piece.
+func lowerCELLeaf(expr *exprpb.Expr) (*celParts, bool) {
+	if matcher, ok := headerMatcherFromExpr(expr); ok {
+		return &celParts{Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Header{Header: matcher}}}}, true
+	}
+	if matcher, ok := pathOrMethodMatcherFromExpr(expr); ok {
+		return &celParts{Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Header{Header: matcher}}}}, true
+	}
+	if port, ok := destinationPortFromExpr(expr); ok {
+		return &celParts{Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_DestinationPort{DestinationPort: port}}}}, true
+	}
+	if cidr, ok := sourceIPCidrFromExpr(expr); ok {
+		return &celParts{Principals: []*rbacconfig.Principal{{Identifier: &rbacconfig.Principal_SourceIp{SourceIp: cidr}}}}, true
+	}
+	return nil, false
+}
+
+// compileCELCondition lowers a CEL condition into a single Envoy RBAC policy,
+// short-circuiting `&&`/`||`/`!` and natively matching header, path, method, destination
+// port and source IP CIDR predicates. It deliberately has no fallback: a condition that
+// mixes in something this package doesn't know how to lower natively (e.g. a
+// request.time comparison) is rejected with an error rather than silently enforced as an
+// always-allow policy, since there is no ext_authz/Lua backend in this codebase that could
+// actually evaluate the rest of the expression at runtime.
+func compileCELCondition(expr string) (*rbacconfig.Policy, error) {
+	rootExpr, err := compileCELExpr(expr)
+	if err != nil {
+		return nil, err
+	}
+
+	parts, ok := lowerCELBoolean(rootExpr)
+	if !ok {
+		return nil, fmt.Errorf("CEL condition %q cannot be lowered to a native Envoy RBAC policy; "+
+			"rewrite it in terms of header, path, method, destination port or source IP "+
+			"predicates combined with && / || / !", expr)
+	}
+
+	return &rbacconfig.Policy{
+		Permissions: combinedPermissions(parts.Permissions),
+		Principals:  combinedPrincipals(parts.Principals),
+	}, nil
+}
+
+// combinedPermissions collapses permission pieces accumulated across an && chain into the
+// single Permission list a Policy expects, ANDing more than one together and defaulting to
+// "any" when the condition carried no permission-side predicate at all.
+func combinedPermissions(permissions []*rbacconfig.Permission) []*rbacconfig.Permission {
+	switch len(permissions) {
+	case 0:
+		return []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_Any{Any: true}}}
+	case 1:
+		return permissions
+	default:
+		return []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_AndRules{
+			AndRules: &rbacconfig.Permission_Set{Rules: permissions},
+		}}}
+	}
+}
+
+// combinedPrincipals is the Principal-side counterpart of combinedPermissions.
+func combinedPrincipals(principals []*rbacconfig.Principal) []*rbacconfig.Principal {
+	switch len(principals) {
+	case 0:
+		return []*rbacconfig.Principal{{Identifier: &rbacconfig.Principal_Any{Any: true}}}
+	case 1:
+		return principals
+	default:
+		return []*rbacconfig.Principal{{Identifier: &rbacconfig.Principal_AndIds{
+			AndIds: &rbacconfig.Principal_Set{Ids: principals},
+		}}}
+	}
+}
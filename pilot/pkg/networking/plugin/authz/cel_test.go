@@ -0,0 +1,247 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	rbacconfig "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2alpha"
+)
+
+func TestConvertToCELCondition(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Expr   string
+		Expect *route.HeaderMatcher
+		Err    string
+	}{
+		{
+			Name: "exact match",
+			Expr: `request.headers['x-user'] == 'admin'`,
+			Expect: &route.HeaderMatcher{
+				Name: "x-user",
+				HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{
+					ExactMatch: "admin",
+				},
+			},
+		},
+		{
+			Name: "exact match against the empty string",
+			Expr: `request.headers['x-user'] == ''`,
+			Expect: &route.HeaderMatcher{
+				Name: "x-user",
+				HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{
+					ExactMatch: "",
+				},
+			},
+		},
+		{
+			Name:   "startsWith lowers to a prefix match",
+			Expr:   `request.headers['x-user'].startsWith('admin-')`,
+			Expect: convertToHeaderMatcher("x-user", "admin-*"),
+		},
+		{
+			Name:   "endsWith lowers to a suffix match",
+			Expr:   `request.headers['x-user'].endsWith('-admin')`,
+			Expect: convertToHeaderMatcher("x-user", "*-admin"),
+		},
+		{
+			Name:   "contains lowers to wildcard regex",
+			Expr:   `request.headers['x-user'].contains('admin')`,
+			Expect: convertToHeaderMatcher("x-user", "*admin*"),
+		},
+		{
+			Name: "boolean combination does not reduce to one header match",
+			Expr: `request.headers['x-user'].startsWith('admin-') && source.ip.inCidr('10.0.0.0/8')`,
+			Err:  "does not reduce to a single header match",
+		},
+		{
+			Name: "malformed expression",
+			Expr: `request.headers[`,
+			Err:  "invalid CEL condition",
+		},
+	}
+
+	for _, tc := range testCases {
+		actual, err := convertToCELCondition(tc.Expr)
+		if tc.Err != "" {
+			if err == nil {
+				t.Errorf("%s: expecting error: %s but found no error", tc.Name, tc.Err)
+			} else if !strings.Contains(err.Error(), tc.Err) {
+				t.Errorf("%s: expecting error: %s, but got: %s", tc.Name, tc.Err, err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(*tc.Expect, *actual) {
+			t.Errorf("%s: expecting %v, but got %v", tc.Name, *tc.Expect, *actual)
+		}
+	}
+}
+
+func TestCompileCELCondition(t *testing.T) {
+	testCases := []struct {
+		Name         string
+		Expr         string
+		ExpectPolicy *rbacconfig.Policy
+		Err          string
+	}{
+		{
+			Name: "conjunction of a header and a path predicate lowers natively",
+			Expr: `request.headers['x-user'].startsWith('admin-') && request.path == '/admin'`,
+			ExpectPolicy: &rbacconfig.Policy{
+				Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_AndRules{
+					AndRules: &rbacconfig.Permission_Set{Rules: []*rbacconfig.Permission{
+						{Rule: &rbacconfig.Permission_Header{Header: convertToHeaderMatcher("x-user", "admin-*")}},
+						{Rule: &rbacconfig.Permission_Header{Header: convertToHeaderMatcher(":path", "/admin")}},
+					}},
+				}}},
+				Principals: []*rbacconfig.Principal{{Identifier: &rbacconfig.Principal_Any{Any: true}}},
+			},
+		},
+		{
+			Name: "conjunction of a permission and a principal predicate lowers natively",
+			Expr: `request.method == 'GET' && source.ip.inCidr('10.0.0.0/8')`,
+			ExpectPolicy: &rbacconfig.Policy{
+				Permissions: []*rbacconfig.Permission{
+					{Rule: &rbacconfig.Permission_Header{Header: convertToHeaderMatcher(":method", "GET")}},
+				},
+				Principals: []*rbacconfig.Principal{
+					{Identifier: &rbacconfig.Principal_SourceIp{SourceIp: mustCidr("10.0.0.0/8")}},
+				},
+			},
+		},
+		{
+			Name: "destination port equality lowers natively",
+			Expr: `destination.port == 443`,
+			ExpectPolicy: &rbacconfig.Policy{
+				Permissions: []*rbacconfig.Permission{
+					{Rule: &rbacconfig.Permission_DestinationPort{DestinationPort: 443}},
+				},
+				Principals: []*rbacconfig.Principal{{Identifier: &rbacconfig.Principal_Any{Any: true}}},
+			},
+		},
+		{
+			Name: "disjunction of header predicates lowers natively",
+			Expr: `request.headers['x-user'] == 'admin' || request.headers['x-user'] == 'root'`,
+			ExpectPolicy: &rbacconfig.Policy{
+				Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_OrRules{
+					OrRules: &rbacconfig.Permission_Set{Rules: []*rbacconfig.Permission{
+						{Rule: &rbacconfig.Permission_Header{Header: convertToHeaderMatcher("x-user", "admin")}},
+						{Rule: &rbacconfig.Permission_Header{Header: convertToHeaderMatcher("x-user", "root")}},
+					}},
+				}}},
+				Principals: []*rbacconfig.Principal{{Identifier: &rbacconfig.Principal_Any{Any: true}}},
+			},
+		},
+		{
+			Name: "negation lowers natively",
+			Expr: `!(request.headers['x-user'] == 'guest')`,
+			ExpectPolicy: &rbacconfig.Policy{
+				Permissions: []*rbacconfig.Permission{{Rule: &rbacconfig.Permission_NotRule{
+					NotRule: &rbacconfig.Permission{Rule: &rbacconfig.Permission_Header{Header: convertToHeaderMatcher("x-user", "guest")}},
+				}}},
+				Principals: []*rbacconfig.Principal{{Identifier: &rbacconfig.Principal_Any{Any: true}}},
+			},
+		},
+		{
+			Name: "disjunction mixing a permission and a principal predicate is rejected",
+			Expr: `request.path == '/admin' || source.ip.inCidr('10.0.0.0/8')`,
+			Err:  "cannot be lowered",
+		},
+		{
+			Name: "request.time comparison has no native matcher and is rejected",
+			Expr: `request.time.getHours() >= 9`,
+			Err:  "cannot be lowered",
+		},
+	}
+
+	for _, tc := range testCases {
+		policy, err := compileCELCondition(tc.Expr)
+		if tc.Err != "" {
+			if err == nil {
+				t.Errorf("%s: expecting error: %s but found no error", tc.Name, tc.Err)
+			} else if !strings.Contains(err.Error(), tc.Err) {
+				t.Errorf("%s: expecting error: %s, but got: %s", tc.Name, tc.Err, err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.ExpectPolicy, policy) {
+			t.Errorf("%s: expecting %v, but got %v", tc.Name, tc.ExpectPolicy, policy)
+		}
+	}
+}
+
+func TestValidateCELCondition(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Expr string
+		Err  string
+	}{
+		{
+			Name: "valid condition",
+			Expr: `request.headers['x-user'].startsWith('admin-') && source.ip.inCidr('10.0.0.0/8')`,
+		},
+		{
+			Name: "unknown attribute",
+			Expr: `request.bogus == 'admin'`,
+			Err:  "invalid CEL condition",
+		},
+		{
+			Name: "syntax error",
+			Expr: `request.headers[`,
+			Err:  "invalid CEL condition",
+		},
+		{
+			Name: "well-typed but not lowerable is also rejected",
+			Expr: `request.time.getHours() >= 9`,
+			Err:  "cannot be lowered",
+		},
+	}
+
+	for _, tc := range testCases {
+		err := ValidateCELCondition(tc.Expr)
+		if tc.Err == "" {
+			if err != nil {
+				t.Errorf("%s: unexpected error: %v", tc.Name, err)
+			}
+			continue
+		}
+		if err == nil {
+			t.Errorf("%s: expecting error: %s but found no error", tc.Name, tc.Err)
+		} else if !strings.Contains(err.Error(), tc.Err) {
+			t.Errorf("%s: expecting error: %s, but got: %s", tc.Name, tc.Err, err.Error())
+		}
+	}
+}
+
+func mustCidr(v string) *core.CidrRange {
+	cidr, err := convertToCidr(v)
+	if err != nil {
+		panic(err)
+	}
+	return cidr
+}
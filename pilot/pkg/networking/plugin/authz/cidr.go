@@ -0,0 +1,198 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"fmt"
+	"math/big"
+	"net"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	rbacconfig "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2alpha"
+	"github.com/gogo/protobuf/types"
+)
+
+// convertToCidrSet parses v into an include and an exclude set of CidrRange, so policies
+// can express things like "10.0.0.0/8,!10.0.5.0/24" (a /8 except one /24) or
+// "10.0.0.5-10.0.0.42" (a dashed range expanded to its minimal covering CIDR blocks). Each
+// comma-separated token in v is one of: a single IP or CIDR block handled by
+// convertToCidr, or a dashed "A-B" range; either may be prefixed with "!" to mark it for
+// exclusion.
+func convertToCidrSet(v string) ([]*core.CidrRange, []*core.CidrRange, error) {
+	var include, exclude []*core.CidrRange
+
+	for _, tok := range strings.Split(v, ",") {
+		tok = strings.TrimSpace(tok)
+		if tok == "" {
+			continue
+		}
+
+		isExclude := strings.HasPrefix(tok, "!")
+		if isExclude {
+			tok = strings.TrimPrefix(tok, "!")
+		}
+
+		var ranges []*core.CidrRange
+		if start, end, ok := splitDashedRange(tok); ok {
+			r, err := convertToCidrRange(start, end)
+			if err != nil {
+				return nil, nil, err
+			}
+			ranges = r
+		} else {
+			cidr, err := convertToCidr(tok)
+			if err != nil {
+				return nil, nil, err
+			}
+			ranges = []*core.CidrRange{cidr}
+		}
+
+		if isExclude {
+			exclude = append(exclude, ranges...)
+		} else {
+			include = append(include, ranges...)
+		}
+	}
+
+	return include, exclude, nil
+}
+
+// splitDashedRange splits "A-B" into its two endpoints. It returns ok=false for anything
+// that isn't exactly two tokens separated by a single "-", or that contains a "/" (a CIDR
+// block is never a dashed range, even a malformed one), so neither a plain IPv6 address
+// nor a CIDR with a stray "-" in its prefix length is mistaken for a range.
+func splitDashedRange(tok string) (start, end string, ok bool) {
+	if strings.Contains(tok, "/") {
+		return "", "", false
+	}
+	parts := strings.Split(tok, "-")
+	if len(parts) != 2 {
+		return "", "", false
+	}
+	return parts[0], parts[1], true
+}
+
+// convertToCidrRange expands the inclusive IP range [start, end] into the minimal list of
+// CidrRange blocks that covers it exactly, using the standard range-to-CIDR algorithm:
+// repeatedly emit the largest CIDR block whose start equals the current cursor and whose
+// end does not exceed the range end, then advance the cursor past it.
+func convertToCidrRange(start, end string) ([]*core.CidrRange, error) {
+	startIP := net.ParseIP(start)
+	endIP := net.ParseIP(end)
+	if startIP == nil || endIP == nil {
+		return nil, fmt.Errorf("invalid ip range: %s-%s", start, end)
+	}
+
+	startIP4, endIP4 := startIP.To4(), endIP.To4()
+	if (startIP4 == nil) != (endIP4 == nil) {
+		return nil, fmt.Errorf("invalid ip range: %s-%s: mixed address families", start, end)
+	}
+	if startIP4 != nil {
+		startIP, endIP = startIP4, endIP4
+	} else {
+		startIP, endIP = startIP.To16(), endIP.To16()
+	}
+	bits := len(startIP) * 8
+
+	cur := new(big.Int).SetBytes(startIP)
+	last := new(big.Int).SetBytes(endIP)
+	if cur.Cmp(last) > 0 {
+		return nil, fmt.Errorf("invalid ip range: %s-%s: start after end", start, end)
+	}
+
+	one := big.NewInt(1)
+	var out []*core.CidrRange
+	for cur.Cmp(last) <= 0 {
+		prefixLen := bits
+		for prefixLen > 0 {
+			blockSize := new(big.Int).Lsh(one, uint(bits-(prefixLen-1)))
+			if new(big.Int).Mod(cur, blockSize).Sign() != 0 {
+				break
+			}
+			blockEnd := new(big.Int).Sub(new(big.Int).Add(cur, blockSize), one)
+			if blockEnd.Cmp(last) > 0 {
+				break
+			}
+			prefixLen--
+		}
+
+		blockSize := new(big.Int).Lsh(one, uint(bits-prefixLen))
+		blockEnd := new(big.Int).Sub(new(big.Int).Add(cur, blockSize), one)
+
+		out = append(out, &core.CidrRange{
+			AddressPrefix: bigIntToIP(cur, bits/8).String(),
+			PrefixLen:     &types.UInt32Value{Value: uint32(prefixLen)},
+		})
+
+		cur = new(big.Int).Add(blockEnd, one)
+	}
+	return out, nil
+}
+
+// bigIntToIP renders i as a net.IP of byteLen bytes, left-padding with zeros, since
+// big.Int.Bytes trims leading zero bytes that are significant for an IP address.
+func bigIntToIP(i *big.Int, byteLen int) net.IP {
+	b := i.Bytes()
+	ip := make([]byte, byteLen)
+	copy(ip[byteLen-len(b):], b)
+	return net.IP(ip)
+}
+
+// principalForCidrSet builds the RBAC principal for v, combining the include set with a
+// NotId over the exclude set so "allow 10.0.0.0/8 except 10.0.5.0/24" compiles to the
+// single policy `SourceIp in 10.0.0.0/8 AND NOT (SourceIp in 10.0.5.0/24)`.
+func principalForCidrSet(v string) (*rbacconfig.Principal, error) {
+	include, exclude, err := convertToCidrSet(v)
+	if err != nil {
+		return nil, err
+	}
+
+	principal := principalForCidrs(include)
+	if len(exclude) == 0 {
+		return principal, nil
+	}
+
+	return &rbacconfig.Principal{
+		Identifier: &rbacconfig.Principal_AndIds{AndIds: &rbacconfig.Principal_Set{
+			Ids: []*rbacconfig.Principal{
+				principal,
+				{Identifier: &rbacconfig.Principal_NotId{NotId: principalForCidrs(exclude)}},
+			},
+		}},
+	}, nil
+}
+
+// principalForCidrs returns the principal matching any one of cidrs, collapsing to a bare
+// SourceIp identifier when there is exactly one and to Principal_Any when cidrs is empty
+// (e.g. an exclude-only set like "!10.0.5.0/24", which should read as "anyone except"
+// rather than an OrIds with zero alternatives, whose match semantics are undefined).
+func principalForCidrs(cidrs []*core.CidrRange) *rbacconfig.Principal {
+	if len(cidrs) == 0 {
+		return &rbacconfig.Principal{Identifier: &rbacconfig.Principal_Any{Any: true}}
+	}
+	ids := make([]*rbacconfig.Principal, 0, len(cidrs))
+	for _, cidr := range cidrs {
+		ids = append(ids, &rbacconfig.Principal{
+			Identifier: &rbacconfig.Principal_SourceIp{SourceIp: cidr},
+		})
+	}
+	if len(ids) == 1 {
+		return ids[0]
+	}
+	return &rbacconfig.Principal{
+		Identifier: &rbacconfig.Principal_OrIds{OrIds: &rbacconfig.Principal_Set{Ids: ids}},
+	}
+}
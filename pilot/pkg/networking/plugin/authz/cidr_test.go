@@ -0,0 +1,192 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	rbacconfig "github.com/envoyproxy/go-control-plane/envoy/config/rbac/v2alpha"
+	"github.com/gogo/protobuf/types"
+)
+
+func cidr(prefix string, length uint32) *core.CidrRange {
+	return &core.CidrRange{
+		AddressPrefix: prefix,
+		PrefixLen:     &types.UInt32Value{Value: length},
+	}
+}
+
+func TestConvertToCidrSet(t *testing.T) {
+	testCases := []struct {
+		Name          string
+		V             string
+		ExpectInclude []*core.CidrRange
+		ExpectExclude []*core.CidrRange
+		Err           string
+	}{
+		{
+			Name:          "comma separated cidrs",
+			V:             "10.0.0.0/8,192.168.0.0/16",
+			ExpectInclude: []*core.CidrRange{cidr("10.0.0.0", 8), cidr("192.168.0.0", 16)},
+		},
+		{
+			Name:          "exclude list",
+			V:             "10.0.0.0/8,!10.0.5.0/24,!10.0.6.0/24",
+			ExpectInclude: []*core.CidrRange{cidr("10.0.0.0", 8)},
+			ExpectExclude: []*core.CidrRange{cidr("10.0.5.0", 24), cidr("10.0.6.0", 24)},
+		},
+		{
+			Name:          "ipv4 dashed range",
+			V:             "10.0.0.0-10.0.0.3",
+			ExpectInclude: []*core.CidrRange{cidr("10.0.0.0", 30)},
+		},
+		{
+			Name:          "ipv4 dashed range needing multiple blocks",
+			V:             "10.0.0.1-10.0.0.4",
+			ExpectInclude: []*core.CidrRange{cidr("10.0.0.1", 32), cidr("10.0.0.2", 31), cidr("10.0.0.4", 32)},
+		},
+		{
+			Name:          "ipv6 dashed range",
+			V:             "2001:db8::-2001:db8::3",
+			ExpectInclude: []*core.CidrRange{cidr("2001:db8::", 126)},
+		},
+		{
+			Name: "mixed address families",
+			V:    "10.0.0.0-2001:db8::1",
+			Err:  "mixed address families",
+		},
+		{
+			Name: "cidr with two /",
+			V:    "192.168.0.0//16",
+			Err:  "invalid cidr range",
+		},
+		{
+			Name: "cidr with negative prefix length",
+			V:    "192.168.0.0/-16",
+			Err:  "invalid cidr range",
+		},
+		{
+			Name: "junk",
+			V:    "not-an-ip",
+			Err:  "invalid ip",
+		},
+	}
+
+	for _, tc := range testCases {
+		include, exclude, err := convertToCidrSet(tc.V)
+		if tc.Err != "" {
+			if err == nil {
+				t.Errorf("%s: expecting error: %s but found no error", tc.Name, tc.Err)
+			} else if !strings.Contains(err.Error(), tc.Err) {
+				t.Errorf("%s: expecting error: %s, but got: %s", tc.Name, tc.Err, err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.ExpectInclude, include) {
+			t.Errorf("%s: expecting include %v, but got %v", tc.Name, tc.ExpectInclude, include)
+		}
+		if !reflect.DeepEqual(tc.ExpectExclude, exclude) {
+			t.Errorf("%s: expecting exclude %v, but got %v", tc.Name, tc.ExpectExclude, exclude)
+		}
+	}
+}
+
+func TestPrincipalForCidrSet(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		V      string
+		Expect *rbacconfig.Principal
+		Err    string
+	}{
+		{
+			Name: "include only, single cidr collapses to a bare SourceIp",
+			V:    "10.0.0.0/8",
+			Expect: &rbacconfig.Principal{
+				Identifier: &rbacconfig.Principal_SourceIp{SourceIp: cidr("10.0.0.0", 8)},
+			},
+		},
+		{
+			Name: "multiple includes combine with OrIds",
+			V:    "10.0.0.0/8,192.168.0.0/16",
+			Expect: &rbacconfig.Principal{
+				Identifier: &rbacconfig.Principal_OrIds{OrIds: &rbacconfig.Principal_Set{
+					Ids: []*rbacconfig.Principal{
+						{Identifier: &rbacconfig.Principal_SourceIp{SourceIp: cidr("10.0.0.0", 8)}},
+						{Identifier: &rbacconfig.Principal_SourceIp{SourceIp: cidr("192.168.0.0", 16)}},
+					},
+				}},
+			},
+		},
+		{
+			Name: "include with exclude compiles to a single AndIds/NotId policy",
+			V:    "10.0.0.0/8,!10.0.5.0/24",
+			Expect: &rbacconfig.Principal{
+				Identifier: &rbacconfig.Principal_AndIds{AndIds: &rbacconfig.Principal_Set{
+					Ids: []*rbacconfig.Principal{
+						{Identifier: &rbacconfig.Principal_SourceIp{SourceIp: cidr("10.0.0.0", 8)}},
+						{Identifier: &rbacconfig.Principal_NotId{NotId: &rbacconfig.Principal{
+							Identifier: &rbacconfig.Principal_SourceIp{SourceIp: cidr("10.0.5.0", 24)},
+						}}},
+					},
+				}},
+			},
+		},
+		{
+			Name: "exclude only falls back to Any rather than an empty OrIds",
+			V:    "!10.0.5.0/24",
+			Expect: &rbacconfig.Principal{
+				Identifier: &rbacconfig.Principal_AndIds{AndIds: &rbacconfig.Principal_Set{
+					Ids: []*rbacconfig.Principal{
+						{Identifier: &rbacconfig.Principal_Any{Any: true}},
+						{Identifier: &rbacconfig.Principal_NotId{NotId: &rbacconfig.Principal{
+							Identifier: &rbacconfig.Principal_SourceIp{SourceIp: cidr("10.0.5.0", 24)},
+						}}},
+					},
+				}},
+			},
+		},
+		{
+			Name: "invalid token still surfaces the convertToCidrSet error",
+			V:    "192.168.0.0//16",
+			Err:  "invalid cidr range",
+		},
+	}
+
+	for _, tc := range testCases {
+		actual, err := principalForCidrSet(tc.V)
+		if tc.Err != "" {
+			if err == nil {
+				t.Errorf("%s: expecting error: %s but found no error", tc.Name, tc.Err)
+			} else if !strings.Contains(err.Error(), tc.Err) {
+				t.Errorf("%s: expecting error: %s, but got: %s", tc.Name, tc.Err, err.Error())
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: unexpected error: %v", tc.Name, err)
+			continue
+		}
+		if !reflect.DeepEqual(tc.Expect, actual) {
+			t.Errorf("%s: expecting %v, but got %v", tc.Name, tc.Expect, actual)
+		}
+	}
+}
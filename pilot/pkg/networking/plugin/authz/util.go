@@ -0,0 +1,152 @@
+// Copyright 2018 Istio Authors
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//     http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package authz
+
+import (
+	"fmt"
+	"net"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
+	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
+	"github.com/gogo/protobuf/types"
+)
+
+// headerRange matches the "[N,M)" syntax used to express a numeric header range, e.g. a
+// range of HTTP status codes or ports carried in a header value.
+var headerRange = regexp.MustCompile(`^\[(-?[0-9]+),(-?[0-9]+)\)$`)
+
+// stringMatch returns true if s matches any pattern in the list, where a pattern
+// may use a leading or trailing "*" as a wildcard, e.g. "ns-*" matches anything
+// that starts with "ns-".
+func stringMatch(s string, list []string) bool {
+	for _, pattern := range list {
+		if matchWithWildcard(pattern, s) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchWithWildcard(pattern, s string) bool {
+	switch {
+	case pattern == "*":
+		return true
+	case strings.HasPrefix(pattern, "*"):
+		return strings.HasSuffix(s, strings.TrimPrefix(pattern, "*"))
+	case strings.HasSuffix(pattern, "*"):
+		return strings.HasPrefix(s, strings.TrimSuffix(pattern, "*"))
+	default:
+		return s == pattern
+	}
+}
+
+// convertToCidr converts a string v to CIDR, where v can be a single IP address, e.g. "1.2.3.4"
+// or a CIDR range, e.g. "1.2.3.0/24".
+func convertToCidr(v string) (*core.CidrRange, error) {
+	if strings.Count(v, "/") == 1 {
+		ip, ipNet, err := net.ParseCIDR(v)
+		if err != nil {
+			return nil, fmt.Errorf("invalid cidr range: %v", err)
+		}
+		ones, _ := ipNet.Mask.Size()
+		return &core.CidrRange{
+			AddressPrefix: ip.String(),
+			PrefixLen:     &types.UInt32Value{Value: uint32(ones)},
+		}, nil
+	} else if strings.Count(v, "/") > 1 {
+		return nil, fmt.Errorf("invalid cidr range: %s", v)
+	}
+
+	if ip := net.ParseIP(v); ip == nil {
+		return nil, fmt.Errorf("invalid ip address: %s", v)
+	}
+
+	prefixLen := uint32(32)
+	if strings.Contains(v, ":") {
+		prefixLen = 128
+	}
+	return &core.CidrRange{
+		AddressPrefix: v,
+		PrefixLen:     &types.UInt32Value{Value: prefixLen},
+	}, nil
+}
+
+// convertToPort converts a string v to a uint32 port number, returning an error if v is
+// not a valid port.
+func convertToPort(v string) (uint32, error) {
+	p, err := strconv.ParseUint(v, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid port %s: %v", v, err)
+	}
+	if p > 65535 {
+		return 0, fmt.Errorf("invalid port %s: out of range", v)
+	}
+	return uint32(p), nil
+}
+
+// convertToHeaderMatcher converts a key, value pair to a HeaderMatcher. v is interpreted,
+// in order: each leading "!" inverts the match of the remaining value (so "!!admin" is two
+// negations and matches exactly "admin"), "*" alone requires the header to be present, "[N,M)" matches a numeric
+// header range, a value with no wildcard requires an exact match, "foo*"/"*foo" match a
+// prefix/suffix, and anything else that mixes wildcards falls back to a compiled regex so
+// existing glob semantics are preserved.
+func convertToHeaderMatcher(k, v string) *route.HeaderMatcher {
+	if strings.HasPrefix(v, "!") {
+		headerMatcher := convertToHeaderMatcher(k, strings.TrimPrefix(v, "!"))
+		headerMatcher.InvertMatch = !headerMatcher.InvertMatch
+		return headerMatcher
+	}
+
+	headerMatcher := &route.HeaderMatcher{
+		Name: k,
+	}
+
+	switch {
+	case v == "*":
+		headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_PresentMatch{
+			PresentMatch: true,
+		}
+	case headerRange.MatchString(v):
+		m := headerRange.FindStringSubmatch(v)
+		start, _ := strconv.ParseInt(m[1], 10, 64)
+		end, _ := strconv.ParseInt(m[2], 10, 64)
+		headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_RangeMatch{
+			RangeMatch: &envoytype.Int64Range{Start: start, End: end},
+		}
+	case !strings.Contains(v, "*"):
+		headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_ExactMatch{
+			ExactMatch: v,
+		}
+	case strings.Count(v, "*") == 1 && strings.HasSuffix(v, "*"):
+		headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_PrefixMatch{
+			PrefixMatch: strings.TrimSuffix(v, "*"),
+		}
+	case strings.Count(v, "*") == 1 && strings.HasPrefix(v, "*"):
+		headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_SuffixMatch{
+			SuffixMatch: strings.TrimPrefix(v, "*"),
+		}
+	default:
+		regex := regexp.QuoteMeta(v)
+		regex = strings.Replace(regex, "\\*", ".*", -1)
+		headerMatcher.HeaderMatchSpecifier = &route.HeaderMatcher_RegexMatch{
+			RegexMatch: fmt.Sprintf("^%s$", regex),
+		}
+	}
+	return headerMatcher
+}
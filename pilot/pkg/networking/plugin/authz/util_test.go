@@ -16,11 +16,14 @@ package authz
 
 import (
 	"reflect"
+	"regexp"
+	"strconv"
 	"strings"
 	"testing"
 
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/core"
 	"github.com/envoyproxy/go-control-plane/envoy/api/v2/route"
+	envoytype "github.com/envoyproxy/go-control-plane/envoy/type"
 	"github.com/gogo/protobuf/types"
 )
 
@@ -199,6 +202,74 @@ func TestConvertToHeaderMatcher(t *testing.T) {
 				},
 			},
 		},
+		{
+			Name: "prefix match",
+			K:    ":path",
+			V:    "/productpage*",
+			Expect: &route.HeaderMatcher{
+				Name: ":path",
+				HeaderMatchSpecifier: &route.HeaderMatcher_PrefixMatch{
+					PrefixMatch: "/productpage",
+				},
+			},
+		},
+		{
+			Name: "suffix match",
+			K:    ":path",
+			V:    "*/productpage",
+			Expect: &route.HeaderMatcher{
+				Name: ":path",
+				HeaderMatchSpecifier: &route.HeaderMatcher_SuffixMatch{
+					SuffixMatch: "/productpage",
+				},
+			},
+		},
+		{
+			Name: "present match",
+			K:    "x-user",
+			V:    "*",
+			Expect: &route.HeaderMatcher{
+				Name: "x-user",
+				HeaderMatchSpecifier: &route.HeaderMatcher_PresentMatch{
+					PresentMatch: true,
+				},
+			},
+		},
+		{
+			Name: "range match",
+			K:    "x-status",
+			V:    "[400,500)",
+			Expect: &route.HeaderMatcher{
+				Name: "x-status",
+				HeaderMatchSpecifier: &route.HeaderMatcher_RangeMatch{
+					RangeMatch: &envoytype.Int64Range{Start: 400, End: 500},
+				},
+			},
+		},
+		{
+			Name: "invert exact match",
+			K:    "x-user",
+			V:    "!admin",
+			Expect: &route.HeaderMatcher{
+				Name:        "x-user",
+				InvertMatch: true,
+				HeaderMatchSpecifier: &route.HeaderMatcher_ExactMatch{
+					ExactMatch: "admin",
+				},
+			},
+		},
+		{
+			Name: "invert prefix match",
+			K:    "x-user",
+			V:    "!admin*",
+			Expect: &route.HeaderMatcher{
+				Name:        "x-user",
+				InvertMatch: true,
+				HeaderMatchSpecifier: &route.HeaderMatcher_PrefixMatch{
+					PrefixMatch: "admin",
+				},
+			},
+		},
 	}
 
 	for _, tc := range testCases {
@@ -208,3 +279,121 @@ func TestConvertToHeaderMatcher(t *testing.T) {
 		}
 	}
 }
+
+// globMatch is an independent reference implementation of the full glob semantics
+// convertToHeaderMatcher lowers: a leading "!" inverts, "*" alone is present-match,
+// "[N,M)" is a numeric range, no "*" is an exact match, a single leading or trailing "*"
+// is a suffix/prefix match, and anything else (genuinely mixed wildcards) behaves like the
+// compiled regex convertToHeaderMatcher falls back to.
+func globMatch(v, s string) bool {
+	invert := false
+	for strings.HasPrefix(v, "!") {
+		invert = !invert
+		v = strings.TrimPrefix(v, "!")
+	}
+
+	var result bool
+	switch {
+	case v == "*":
+		result = true
+	case headerRange.MatchString(v):
+		m := headerRange.FindStringSubmatch(v)
+		start, _ := strconv.ParseInt(m[1], 10, 64)
+		end, _ := strconv.ParseInt(m[2], 10, 64)
+		n, err := strconv.ParseInt(s, 10, 64)
+		result = err == nil && n >= start && n < end
+	case !strings.Contains(v, "*"):
+		result = v == s
+	case strings.Count(v, "*") == 1 && strings.HasSuffix(v, "*"):
+		result = strings.HasPrefix(s, strings.TrimSuffix(v, "*"))
+	case strings.Count(v, "*") == 1 && strings.HasPrefix(v, "*"):
+		result = strings.HasSuffix(s, strings.TrimPrefix(v, "*"))
+	default:
+		regex := regexp.QuoteMeta(v)
+		regex = strings.Replace(regex, "\\*", ".*", -1)
+		result = regexp.MustCompile("^" + regex + "$").MatchString(s)
+	}
+
+	if invert {
+		return !result
+	}
+	return result
+}
+
+func TestConvertToHeaderMatcherGlobSemantics(t *testing.T) {
+	patterns := []string{"*", "admin*", "*admin", "admin", "!admin", "!!admin", "[400,500)"}
+	probes := []string{"admin", "administrator", "super-admin", "guest", "404", ""}
+
+	for _, v := range patterns {
+		matcher := convertToHeaderMatcher(":path", v)
+		for _, s := range probes {
+			want := globMatch(v, s)
+			got := headerMatcherAccepts(matcher, s)
+			if got != want {
+				t.Errorf("pattern %q, input %q: expecting %v, but got %v", v, s, want, got)
+			}
+		}
+	}
+}
+
+// FuzzConvertToHeaderMatcher checks that for any pattern/input pair, the HeaderMatcher
+// convertToHeaderMatcher compiles the pattern into accepts/rejects the input exactly when
+// globMatch's independent reference semantics say it should - across the present,
+// range, invert and genuinely-mixed-wildcard regex-fallback paths, not just exact/prefix/
+// suffix.
+func FuzzConvertToHeaderMatcher(f *testing.F) {
+	seeds := [][2]string{
+		{"*", "anything"},
+		{"admin*", "administrator"},
+		{"*admin", "super-admin"},
+		{"admin", "admin"},
+		{"!admin", "guest"},
+		{"!admin*", "administrator"},
+		{"!!admin", "admin"},
+		{"[400,500)", "404"},
+		{"[400,500)", "399"},
+		{"a*b*c", "aXbXc"},
+		{"a*b*c", "abc"},
+	}
+	for _, sd := range seeds {
+		f.Add(sd[0], sd[1])
+	}
+
+	f.Fuzz(func(t *testing.T, v, s string) {
+		matcher := convertToHeaderMatcher("x-test", v)
+		want := globMatch(v, s)
+		got := headerMatcherAccepts(matcher, s)
+		if got != want {
+			t.Errorf("pattern %q, input %q: expecting %v, but got %v", v, s, want, got)
+		}
+	})
+}
+
+// headerMatcherAccepts evaluates every HeaderMatcher specifier convertToHeaderMatcher can
+// produce against a candidate header value, respecting InvertMatch, so tests can assert
+// the compiled matcher still accepts/rejects what the original glob would have.
+func headerMatcherAccepts(m *route.HeaderMatcher, s string) bool {
+	var result bool
+	switch spec := m.HeaderMatchSpecifier.(type) {
+	case *route.HeaderMatcher_ExactMatch:
+		result = spec.ExactMatch == s
+	case *route.HeaderMatcher_PrefixMatch:
+		result = strings.HasPrefix(s, spec.PrefixMatch)
+	case *route.HeaderMatcher_SuffixMatch:
+		result = strings.HasSuffix(s, spec.SuffixMatch)
+	case *route.HeaderMatcher_PresentMatch:
+		result = spec.PresentMatch
+	case *route.HeaderMatcher_RangeMatch:
+		n, err := strconv.ParseInt(s, 10, 64)
+		result = err == nil && n >= spec.RangeMatch.Start && n < spec.RangeMatch.End
+	case *route.HeaderMatcher_RegexMatch:
+		re, err := regexp.Compile(spec.RegexMatch)
+		result = err == nil && re.MatchString(s)
+	default:
+		result = false
+	}
+	if m.InvertMatch {
+		return !result
+	}
+	return result
+}